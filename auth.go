@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth validates an incoming proxy request before it is forwarded to a
+// backend. An implementation that rejects a request is responsible for
+// writing the appropriate error response (e.g. a 407 challenge) to w.
+type Auth interface {
+	Authenticate(w http.ResponseWriter, r *http.Request) bool
+}
+
+// newAuth builds the Auth backend described by a URL-style spec, e.g.
+// "basicfile:///etc/voidension/users?type=htpasswd", "static://user:pass",
+// "cert:///etc/voidension/ca.pem" or "none://". An empty spec is
+// equivalent to "none://".
+func newAuth(spec string) (Auth, error) {
+	if spec == "" {
+		return noneAuth{}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth spec %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "", "none":
+		return noneAuth{}, nil
+	case "static":
+		return newStaticAuth(u)
+	case "basicfile":
+		return newBasicFileAuth(u)
+	case "cert":
+		return newCertAuth(u)
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", u.Scheme)
+	}
+}
+
+// challengeBasic writes a 407 response with a Basic challenge and reports
+// the request as denied, for use as the tail call in Authenticate methods.
+func challengeBasic(w http.ResponseWriter) bool {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="voidension"`)
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	return false
+}
+
+// basicCredentials extracts and decodes a "Proxy-Authorization: Basic" header.
+func basicCredentials(r *http.Request) (user, pass string, ok bool) {
+	h := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(h, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// noneAuth admits every request; it is the default when no auth backend is
+// configured.
+type noneAuth struct{}
+
+func (noneAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool { return true }
+
+// staticAuth checks a single fixed username/password pair, useful for a
+// quick single-tenant deployment.
+type staticAuth struct {
+	user, pass string
+}
+
+func newStaticAuth(u *url.URL) (Auth, error) {
+	if u.User == nil {
+		return nil, fmt.Errorf("static auth requires a user:pass in the URL")
+	}
+	pass, _ := u.User.Password()
+	return &staticAuth{user: u.User.Username(), pass: pass}, nil
+}
+
+func (a *staticAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := basicCredentials(r)
+	if !ok {
+		return challengeBasic(w)
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass)) == 1
+	if !userOK || !passOK {
+		return challengeBasic(w)
+	}
+	return true
+}
+
+// basicFileAuth authenticates against an htpasswd-style file of
+// "user:bcrypt-hash" lines, reloaded on SIGHUP.
+type basicFileAuth struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string][]byte
+}
+
+func newBasicFileAuth(u *url.URL) (Auth, error) {
+	if t := u.Query().Get("type"); t != "" && t != "htpasswd" {
+		return nil, fmt.Errorf("unsupported basicfile type %q", t)
+	}
+
+	a := &basicFileAuth{path: u.Path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	a.watchReload()
+	return a, nil
+}
+
+func (a *basicFileAuth) reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("reading basicfile %s: %w", a.path, err)
+	}
+
+	users := make(map[string][]byte)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// watchReload reloads the user file whenever the process receives SIGHUP,
+// so credentials can be rotated without a restart.
+func (a *basicFileAuth) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := a.reload(); err != nil {
+				ErrorLog.Printf("Failed to reload basicfile %s: %v", a.path, err)
+			} else {
+				InfoLog.Printf("Reloaded basicfile %s", a.path)
+			}
+		}
+	}()
+}
+
+func (a *basicFileAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := basicCredentials(r)
+	if !ok {
+		return challengeBasic(w)
+	}
+
+	a.mu.RLock()
+	hash, known := a.users[user]
+	a.mu.RUnlock()
+	if !known {
+		return challengeBasic(w)
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return challengeBasic(w)
+	}
+	return true
+}
+
+// certAuth requires a client TLS certificate that chains to a configured CA
+// pool. It only makes sense behind a TLS listener that requests client
+// certificates (see incoming.tls).
+type certAuth struct {
+	caPool *x509.CertPool
+}
+
+func newCertAuth(u *url.URL) (Auth, error) {
+	a := &certAuth{caPool: x509.NewCertPool()}
+	if u.Path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cert auth CA pool: %w", err)
+	}
+	if !a.caPool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", u.Path)
+	}
+	return a, nil
+}
+
+func (a *certAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return false
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         a.caPool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(intermediate)
+	}
+
+	if _, err := r.TLS.PeerCertificates[0].Verify(opts); err != nil {
+		WarnLog.Printf("Client certificate verification failed: %v", err)
+		http.Error(w, "Invalid client certificate", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
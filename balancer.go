@@ -0,0 +1,233 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer selects a backend Server for an incoming request from the given
+// pool. Implementations must be safe for concurrent use and must skip
+// servers that are not currently available (see Server.available).
+type Balancer interface {
+	Select(pool []*Server, r *http.Request) *Server
+}
+
+// newBalancer builds the Balancer configured under outgoing.strategy.
+// An unrecognized or empty strategy falls back to round-robin.
+func newBalancer(cfg *Config) Balancer {
+	switch cfg.Outgoing.Strategy {
+	case "least-connections":
+		return &leastConnectionsBalancer{}
+	case "weighted":
+		return &weightedRandomBalancer{}
+	case "consistent-hash":
+		return &consistentHashBalancer{header: cfg.Outgoing.HashHeader}
+	case "round-robin", "":
+		return &roundRobinBalancer{}
+	default:
+		WarnLog.Printf("Unknown outgoing.strategy %q, falling back to round-robin", cfg.Outgoing.Strategy)
+		return &roundRobinBalancer{}
+	}
+}
+
+// roundRobinBalancer cycles through the pool in declaration order.
+type roundRobinBalancer struct {
+	counter uint64
+}
+
+func (b *roundRobinBalancer) Select(pool []*Server, r *http.Request) *Server {
+	n := len(pool)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&b.counter, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		s := pool[(start+i)%n]
+		if s.available() {
+			return s
+		}
+	}
+	return nil
+}
+
+// leastConnectionsBalancer routes to the available server with the fewest
+// in-flight requests, measured by Server.activeConns.
+type leastConnectionsBalancer struct{}
+
+func (b *leastConnectionsBalancer) Select(pool []*Server, r *http.Request) *Server {
+	var best *Server
+	var bestConns int64
+	for _, s := range pool {
+		if !s.available() {
+			continue
+		}
+		conns := atomic.LoadInt64(&s.activeConns)
+		if best == nil || conns < bestConns {
+			best = s
+			bestConns = conns
+		}
+	}
+	return best
+}
+
+// weightedRandomBalancer picks an available server at random, weighted by
+// Server.Weight.
+type weightedRandomBalancer struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (b *weightedRandomBalancer) Select(pool []*Server, r *http.Request) *Server {
+	total := 0
+	for _, s := range pool {
+		if s.available() {
+			total += s.weight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	if b.rnd == nil {
+		b.rnd = rand.New(rand.NewSource(1))
+	}
+	pick := b.rnd.Intn(total)
+	b.mu.Unlock()
+
+	for _, s := range pool {
+		if !s.available() {
+			continue
+		}
+		w := s.weight()
+		if pick < w {
+			return s
+		}
+		pick -= w
+	}
+	return nil
+}
+
+// hashRingReplicas is the number of ring points placed per unit of weight
+// for each backend, giving heavier servers a proportionally larger share
+// of the key space without skewing distribution.
+const hashRingReplicas = 100
+
+// consistentHashBalancer keys requests by client IP (or a configured
+// header) onto a hash ring, so repeat requests from the same client
+// stickily land on the same backend as long as the pool is unchanged.
+type consistentHashBalancer struct {
+	header string
+
+	mu      sync.Mutex
+	ringKey string
+	ring    hashRing
+}
+
+func (b *consistentHashBalancer) Select(pool []*Server, r *http.Request) *Server {
+	available := make([]*Server, 0, len(pool))
+	for _, s := range pool {
+		if s.available() {
+			available = append(available, s)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	ring := b.ringFor(available)
+	key := b.clientKey(r)
+	return ring.lookup(key)
+}
+
+// ringFor returns the cached ring for this exact set of available servers
+// and weights, only paying buildHashRing's O(n log n) sort when that
+// composition actually changed since the last call — which happens when
+// the health-check loop flips a server's availability or its weight is
+// reconfigured, not on every request.
+func (b *consistentHashBalancer) ringFor(available []*Server) hashRing {
+	key := ringCompositionKey(available)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if key == b.ringKey && b.ring != nil {
+		return b.ring
+	}
+	b.ring = buildHashRing(available)
+	b.ringKey = key
+	return b.ring
+}
+
+// ringCompositionKey cheaply summarizes which servers are available and at
+// what weight, so ringFor can detect a changed pool without rebuilding the
+// ring itself.
+func ringCompositionKey(available []*Server) string {
+	var sb strings.Builder
+	for _, s := range available {
+		sb.WriteString(s.URL)
+		sb.WriteByte(':')
+		sb.WriteString(strconv.Itoa(s.weight()))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+func (b *consistentHashBalancer) clientKey(r *http.Request) string {
+	if b.header != "" {
+		if v := r.Header.Get(b.header); v != "" {
+			return v
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+type hashRingPoint struct {
+	hash   uint32
+	server *Server
+}
+
+type hashRing []hashRingPoint
+
+func buildHashRing(servers []*Server) hashRing {
+	ring := make(hashRing, 0, len(servers)*hashRingReplicas)
+	for _, s := range servers {
+		replicas := s.weight() * hashRingReplicas
+		for i := 0; i < replicas; i++ {
+			point := hashRingPoint{
+				hash:   hashKey(s.URL + "#" + strconv.Itoa(i)),
+				server: s,
+			}
+			ring = append(ring, point)
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func (ring hashRing) lookup(key string) *Server {
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	idx := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if idx == len(ring) {
+		idx = 0
+	}
+	return ring[idx].server
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
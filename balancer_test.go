@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestPool(n int) []*Server {
+	pool := make([]*Server, n)
+	for i := range pool {
+		s := &Server{URL: "http://backend-" + string(rune('a'+i)), Weight: 1}
+		s.Alive.Store(true)
+		pool[i] = s
+	}
+	return pool
+}
+
+func TestRoundRobinBalancerCyclesFairly(t *testing.T) {
+	pool := newTestPool(3)
+	b := &roundRobinBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		s := b.Select(pool, req)
+		if s == nil {
+			t.Fatal("expected a server to be selected")
+		}
+		counts[s.URL]++
+	}
+
+	for _, s := range pool {
+		if counts[s.URL] != 3 {
+			t.Fatalf("expected round-robin to distribute evenly, got %v for %s", counts[s.URL], s.URL)
+		}
+	}
+}
+
+func TestRoundRobinBalancerSkipsUnavailableServers(t *testing.T) {
+	pool := newTestPool(2)
+	pool[0].Alive.Store(false)
+	b := &roundRobinBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	for i := 0; i < 4; i++ {
+		s := b.Select(pool, req)
+		if s != pool[1] {
+			t.Fatalf("expected the only alive server to always be selected, got %v", s)
+		}
+	}
+}
+
+func TestRoundRobinBalancerReturnsNilWhenNoneAvailable(t *testing.T) {
+	pool := newTestPool(2)
+	pool[0].Alive.Store(false)
+	pool[1].Alive.Store(false)
+	b := &roundRobinBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	if s := b.Select(pool, req); s != nil {
+		t.Fatalf("expected nil when no server is available, got %v", s)
+	}
+}
+
+func TestLeastConnectionsBalancerPicksLowestCount(t *testing.T) {
+	pool := newTestPool(3)
+	pool[0].activeConns = 5
+	pool[1].activeConns = 1
+	pool[2].activeConns = 3
+
+	b := &leastConnectionsBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	s := b.Select(pool, req)
+	if s != pool[1] {
+		t.Fatalf("expected the server with the fewest active connections, got %v", s)
+	}
+}
+
+func TestLeastConnectionsBalancerSkipsUnavailableServers(t *testing.T) {
+	pool := newTestPool(2)
+	pool[0].activeConns = 0
+	pool[0].Alive.Store(false)
+	pool[1].activeConns = 10
+
+	b := &leastConnectionsBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	s := b.Select(pool, req)
+	if s != pool[1] {
+		t.Fatalf("expected the only alive server even though it has more connections, got %v", s)
+	}
+}
+
+func TestWeightedRandomBalancerRespectsWeightsOverManyDraws(t *testing.T) {
+	pool := newTestPool(2)
+	pool[0].Weight = 1
+	pool[1].Weight = 3
+
+	b := &weightedRandomBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	counts := map[string]int{}
+	const draws = 4000
+	for i := 0; i < draws; i++ {
+		s := b.Select(pool, req)
+		if s == nil {
+			t.Fatal("expected a server to be selected")
+		}
+		counts[s.URL]++
+	}
+
+	ratio := float64(counts[pool[1].URL]) / float64(counts[pool[0].URL])
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("expected roughly a 3:1 split for weights 1:3, got %v (ratio %.2f)", counts, ratio)
+	}
+}
+
+func TestWeightedRandomBalancerReturnsNilWhenNoneAvailable(t *testing.T) {
+	pool := newTestPool(2)
+	pool[0].Alive.Store(false)
+	pool[1].Alive.Store(false)
+
+	b := &weightedRandomBalancer{}
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+
+	if s := b.Select(pool, req); s != nil {
+		t.Fatalf("expected nil when no server is available, got %v", s)
+	}
+}
+
+func TestConsistentHashBalancerIsStickyForTheSameClient(t *testing.T) {
+	pool := newTestPool(5)
+	b := &consistentHashBalancer{}
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req.RemoteAddr = "198.51.100.7:4242"
+
+	first := b.Select(pool, req)
+	if first == nil {
+		t.Fatal("expected a server to be selected")
+	}
+	for i := 0; i < 10; i++ {
+		if s := b.Select(pool, req); s != first {
+			t.Fatalf("expected the same client to always land on the same backend, got %v on attempt %d, first was %v", s, i, first)
+		}
+	}
+}
+
+func TestConsistentHashBalancerUsesConfiguredHeaderOverRemoteAddr(t *testing.T) {
+	pool := newTestPool(5)
+	b := &consistentHashBalancer{header: "X-Shard-Key"}
+
+	reqA := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	reqA.RemoteAddr = "198.51.100.1:1111"
+	reqA.Header.Set("X-Shard-Key", "tenant-42")
+
+	reqB := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	reqB.RemoteAddr = "198.51.100.2:2222"
+	reqB.Header.Set("X-Shard-Key", "tenant-42")
+
+	if b.Select(pool, reqA) != b.Select(pool, reqB) {
+		t.Fatal("expected two different clients with the same shard header to land on the same backend")
+	}
+}
+
+func TestConsistentHashBalancerMostKeysStayPutWhenOneBackendLeaves(t *testing.T) {
+	full := newTestPool(5)
+	b := &consistentHashBalancer{}
+
+	const clients = 200
+	before := make(map[string]*Server, clients)
+	for i := 0; i < clients; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+		req.RemoteAddr = "10.0." + string(rune('A'+i%26)) + "." + string(rune('a'+i%26)) + ":1234"
+		before[req.RemoteAddr] = b.Select(full, req)
+	}
+
+	reduced := full[:len(full)-1]
+	moved := 0
+	for addr, prevServer := range before {
+		req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+		req.RemoteAddr = addr
+		if s := b.Select(reduced, req); s != prevServer {
+			moved++
+		}
+	}
+
+	// Consistent hashing's whole point is that removing one of N backends
+	// should only remap keys that landed on it, not redistribute
+	// everything; allow some slack but the bulk should stay put.
+	if moved > clients/2 {
+		t.Fatalf("expected consistent hashing to keep most clients on their original backend after one leaves, %d/%d moved", moved, clients)
+	}
+}
+
+func TestRingCompositionKeyChangesWithAvailabilityAndWeight(t *testing.T) {
+	pool := newTestPool(2)
+	key1 := ringCompositionKey(pool)
+
+	pool[0].Weight = 5
+	key2 := ringCompositionKey(pool)
+	if key1 == key2 {
+		t.Fatal("expected the composition key to change when a server's weight changes")
+	}
+
+	key3 := ringCompositionKey(pool[:1])
+	if key2 == key3 {
+		t.Fatal("expected the composition key to change when the available set shrinks")
+	}
+}
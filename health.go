@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig configures active probing for one backend under
+// outgoing.servers[].healthCheck. Probe type defaults to "tcp".
+type HealthCheckConfig struct {
+	Type              string `yaml:"type"` // tcp, http, https
+	Method            string `yaml:"method"`
+	Path              string `yaml:"path"`
+	ExpectedStatus    int    `yaml:"expectedStatus"`
+	ExpectedBodyRegex string `yaml:"expectedBodyRegex"`
+	IntervalMs        int    `yaml:"intervalMs"`
+	TimeoutMs         int    `yaml:"timeoutMs"`
+	RiseThreshold     int    `yaml:"riseThreshold"`
+	FallThreshold     int    `yaml:"fallThreshold"`
+}
+
+// CircuitBreakerConfig configures the live-traffic circuit breaker shared
+// by every backend under outgoing.circuitBreaker.
+type CircuitBreakerConfig struct {
+	FailureRatio   float64 `yaml:"failureRatio"`
+	WindowMs       int     `yaml:"windowMs"`
+	MinRequests    int     `yaml:"minRequests"`
+	BaseCooldownMs int     `yaml:"baseCooldownMs"`
+	MaxCooldownMs  int     `yaml:"maxCooldownMs"`
+}
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type outcomeRecord struct {
+	at     time.Time
+	failed bool
+}
+
+// healthState holds the active-probe and circuit-breaker bookkeeping for
+// one Server. A nil-safe zero value behaves as an always-healthy, always
+// Closed breaker so Server.available() never needs a nil check.
+type healthState struct {
+	server     *Server
+	probe      HealthCheckConfig
+	breakerCfg CircuitBreakerConfig
+
+	mu                 sync.Mutex
+	consecutiveSuccess int
+	consecutiveFailure int
+	lastProbeAt        time.Time
+	lastProbeErr       string
+
+	breakerMu        sync.Mutex
+	state            breakerState
+	openedAt         time.Time
+	cooldown         time.Duration
+	consecutiveOpens int
+	trialInFlight    bool
+	outcomes         []outcomeRecord
+}
+
+func newHealthState(s *Server, probe HealthCheckConfig, breakerCfg CircuitBreakerConfig) *healthState {
+	return &healthState{server: s, probe: probe, breakerCfg: breakerCfg}
+}
+
+func (h *healthState) probeType() string {
+	if h == nil || h.probe.Type == "" {
+		return "tcp"
+	}
+	return h.probe.Type
+}
+
+// allowRequest reports whether a new request may be sent to this backend
+// right now, and admits exactly one trial request while the breaker is
+// HalfOpen.
+func (h *healthState) allowRequest() bool {
+	if h == nil {
+		return true
+	}
+	h.breakerMu.Lock()
+	defer h.breakerMu.Unlock()
+
+	switch h.state {
+	case breakerOpen:
+		if time.Since(h.openedAt) < h.cooldown {
+			return false
+		}
+		h.state = breakerHalfOpen
+		h.trialInFlight = true
+		return true
+	case breakerHalfOpen:
+		if h.trialInFlight {
+			return false
+		}
+		h.trialInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// recordResult feeds a live request outcome into the breaker, closing it
+// after a successful HalfOpen trial, re-opening it after a failed one, and
+// otherwise opening it once the failure ratio over the rolling window
+// crosses breakerCfg.FailureRatio.
+func (h *healthState) recordResult(failed bool) {
+	if h == nil {
+		return
+	}
+	h.breakerMu.Lock()
+	defer h.breakerMu.Unlock()
+
+	if h.state == breakerHalfOpen {
+		h.trialInFlight = false
+		if failed {
+			h.openBreakerLocked()
+		} else {
+			h.state = breakerClosed
+			h.consecutiveOpens = 0
+			h.outcomes = nil
+		}
+		return
+	}
+
+	if h.state != breakerClosed || h.breakerCfg.MinRequests <= 0 {
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(h.breakerCfg.WindowMs) * time.Millisecond
+	cutoff := now.Add(-window)
+
+	kept := h.outcomes[:0]
+	failures := 0
+	for _, o := range h.outcomes {
+		if o.at.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, o)
+		if o.failed {
+			failures++
+		}
+	}
+	if failed {
+		failures++
+	}
+	h.outcomes = append(kept, outcomeRecord{at: now, failed: failed})
+
+	if len(h.outcomes) >= h.breakerCfg.MinRequests {
+		ratio := float64(failures) / float64(len(h.outcomes))
+		if ratio >= h.breakerCfg.FailureRatio {
+			h.openBreakerLocked()
+		}
+	}
+}
+
+// openBreakerLocked must be called with breakerMu held. Each successive
+// open doubles the cool-down, capped at breakerCfg.MaxCooldownMs.
+func (h *healthState) openBreakerLocked() {
+	h.state = breakerOpen
+	h.openedAt = time.Now()
+	h.outcomes = nil
+	h.consecutiveOpens++
+
+	base := time.Duration(h.breakerCfg.BaseCooldownMs) * time.Millisecond
+	if base <= 0 {
+		base = time.Second
+	}
+	cooldown := base << uint(h.consecutiveOpens-1)
+	if max := time.Duration(h.breakerCfg.MaxCooldownMs) * time.Millisecond; max > 0 && cooldown > max {
+		cooldown = max
+	}
+	h.cooldown = cooldown
+
+	ErrorLog.Printf("Circuit breaker for %s opened (cooldown %s)", h.server.URL, h.cooldown)
+}
+
+func (h *healthState) snapshot() (state string, lastProbe time.Time) {
+	h.breakerMu.Lock()
+	state = h.state.String()
+	h.breakerMu.Unlock()
+
+	h.mu.Lock()
+	lastProbe = h.lastProbeAt
+	h.mu.Unlock()
+	return state, lastProbe
+}
+
+// maybeProbe runs a probe if probe.IntervalMs has elapsed since the last
+// one (or immediately, when no per-server interval is configured).
+func (h *healthState) maybeProbe() {
+	interval := time.Duration(h.probe.IntervalMs) * time.Millisecond
+	if interval > 0 {
+		h.mu.Lock()
+		due := time.Since(h.lastProbeAt) >= interval
+		h.mu.Unlock()
+		if !due {
+			return
+		}
+	}
+	h.probeOnce()
+}
+
+func (h *healthState) probeOnce() {
+	ok, detail := h.runProbe()
+
+	h.mu.Lock()
+	h.lastProbeAt = time.Now()
+	h.lastProbeErr = detail
+	if ok {
+		h.consecutiveSuccess++
+		h.consecutiveFailure = 0
+	} else {
+		h.consecutiveFailure++
+		h.consecutiveSuccess = 0
+	}
+
+	rise := h.probe.RiseThreshold
+	if rise <= 0 {
+		rise = 1
+	}
+	fall := h.probe.FallThreshold
+	if fall <= 0 {
+		fall = 1
+	}
+
+	wasAlive := h.server.Alive.Load()
+	nowAlive := wasAlive
+	if ok && h.consecutiveSuccess >= rise {
+		nowAlive = true
+	} else if !ok && h.consecutiveFailure >= fall {
+		nowAlive = false
+	}
+	h.server.Alive.Store(nowAlive)
+	h.mu.Unlock()
+
+	if nowAlive == wasAlive {
+		return
+	}
+	if nowAlive {
+		InfoLog.Printf("Server %s is up (%s probe)", h.server.URL, h.probeType())
+	} else {
+		WarnLog.Printf("Server %s is down (%s probe): %s", h.server.URL, h.probeType(), detail)
+	}
+}
+
+func (h *healthState) runProbe() (bool, string) {
+	timeout := time.Duration(h.probe.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	switch h.probeType() {
+	case "http", "https":
+		return h.runHTTPProbe(timeout)
+	default:
+		return h.runTCPProbe(timeout)
+	}
+}
+
+func (h *healthState) runTCPProbe(timeout time.Duration) (bool, string) {
+	hostPort := extractHostPort(h.server.URL)
+	conn, err := net.DialTimeout("tcp", hostPort, timeout)
+	if err != nil {
+		return false, err.Error()
+	}
+	conn.Close()
+	return true, ""
+}
+
+func (h *healthState) runHTTPProbe(timeout time.Duration) (bool, string) {
+	target := h.server.URL
+	if h.probe.Path != "" {
+		target = strings.TrimRight(target, "/") + h.probe.Path
+	}
+	if h.probe.Type == "https" && strings.HasPrefix(target, "http://") {
+		target = "https://" + strings.TrimPrefix(target, "http://")
+	}
+
+	method := h.probe.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer resp.Body.Close()
+
+	expectedStatus := h.probe.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectedStatus {
+		return false, fmt.Sprintf("status %d, expected %d", resp.StatusCode, expectedStatus)
+	}
+
+	if h.probe.ExpectedBodyRegex != "" {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return false, err.Error()
+		}
+		re, err := regexp.Compile(h.probe.ExpectedBodyRegex)
+		if err != nil {
+			return false, fmt.Sprintf("invalid expectedBodyRegex: %v", err)
+		}
+		if !re.Match(body) {
+			return false, "body did not match expectedBodyRegex"
+		}
+	}
+
+	return true, ""
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func init() {
+	// health_test.go and retry_test.go exercise logging call sites
+	// directly (openBreakerLocked, probeOnce, logProxyOutcome), which
+	// panic on a nil *Logger; give them the same non-nil loggers main()
+	// would have set up, just pointed at io.Discard.
+	discard := newLogger(LevelInfo, io.Discard, "text")
+	InfoLog = discard
+	WarnLog = discard
+	ErrorLog = discard
+	AccessLog = discard
+}
+
+func TestBreakerOpensOnceFailureRatioCrossesThreshold(t *testing.T) {
+	s := &Server{URL: "http://backend-a"}
+	h := newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{
+		FailureRatio:   0.5,
+		WindowMs:       60000,
+		MinRequests:    4,
+		BaseCooldownMs: 50,
+		MaxCooldownMs:  1000,
+	})
+
+	if !h.allowRequest() {
+		t.Fatal("expected a fresh breaker to start closed and admit requests")
+	}
+
+	h.recordResult(false)
+	h.recordResult(true)
+	h.recordResult(true)
+	h.recordResult(true) // 3/4 failures, ratio 0.75 >= 0.5
+
+	if h.allowRequest() {
+		t.Fatal("expected breaker to open once the failure ratio crosses the threshold")
+	}
+	if state, _ := h.snapshot(); state != "open" {
+		t.Fatalf("expected snapshot state open, got %s", state)
+	}
+}
+
+func TestBreakerStaysClosedBelowMinRequests(t *testing.T) {
+	s := &Server{URL: "http://backend-b"}
+	h := newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{
+		FailureRatio:   0.5,
+		WindowMs:       60000,
+		MinRequests:    10,
+		BaseCooldownMs: 50,
+		MaxCooldownMs:  1000,
+	})
+
+	for i := 0; i < 5; i++ {
+		h.recordResult(true)
+	}
+
+	if !h.allowRequest() {
+		t.Fatal("expected breaker to remain closed with fewer than MinRequests observed")
+	}
+}
+
+func TestBreakerHalfOpenAdmitsOneTrialAtATime(t *testing.T) {
+	s := &Server{URL: "http://backend-c"}
+	h := newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{
+		FailureRatio:   0.5,
+		WindowMs:       60000,
+		MinRequests:    1,
+		BaseCooldownMs: 10,
+		MaxCooldownMs:  100,
+	})
+
+	h.recordResult(true) // opens with 1 request at ratio 1.0
+
+	if h.allowRequest() {
+		t.Fatal("expected breaker to deny requests immediately after opening")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !h.allowRequest() {
+		t.Fatal("expected breaker to admit one half-open trial after the cooldown elapses")
+	}
+	if h.allowRequest() {
+		t.Fatal("expected a second concurrent request to be denied while a trial is in flight")
+	}
+
+	h.recordResult(false) // trial succeeds
+	if state, _ := h.snapshot(); state != "closed" {
+		t.Fatalf("expected breaker to close after a successful trial, got %s", state)
+	}
+}
+
+func TestBreakerReopensWithDoubledCooldownOnFailedTrial(t *testing.T) {
+	s := &Server{URL: "http://backend-d"}
+	h := newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{
+		FailureRatio:   0.5,
+		WindowMs:       60000,
+		MinRequests:    1,
+		BaseCooldownMs: 10,
+		MaxCooldownMs:  1000,
+	})
+
+	h.recordResult(true) // open #1, cooldown 10ms
+	time.Sleep(20 * time.Millisecond)
+	if !h.allowRequest() {
+		t.Fatal("expected the first half-open trial to be admitted")
+	}
+
+	h.recordResult(true) // trial fails -> reopen, cooldown doubles
+
+	if state, _ := h.snapshot(); state != "open" {
+		t.Fatalf("expected breaker to reopen after a failed trial, got %s", state)
+	}
+	if h.cooldown != 20*time.Millisecond {
+		t.Fatalf("expected exponential backoff to double the cooldown to 20ms, got %s", h.cooldown)
+	}
+}
+
+func TestBreakerCooldownCapsAtMaxCooldown(t *testing.T) {
+	s := &Server{URL: "http://backend-e"}
+	h := newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{
+		FailureRatio:   0.5,
+		WindowMs:       60000,
+		MinRequests:    1,
+		BaseCooldownMs: 100,
+		MaxCooldownMs:  150,
+	})
+
+	h.recordResult(true) // open #1, cooldown 100ms
+	h.breakerMu.Lock()
+	h.openedAt = time.Now().Add(-time.Hour) // force the cooldown to have already elapsed
+	h.breakerMu.Unlock()
+
+	if !h.allowRequest() {
+		t.Fatal("expected the half-open trial to be admitted once cooldown has elapsed")
+	}
+	h.recordResult(true) // trial fails -> cooldown would double to 200ms, capped to 150ms
+
+	if h.cooldown != 150*time.Millisecond {
+		t.Fatalf("expected cooldown to be capped at 150ms, got %s", h.cooldown)
+	}
+}
+
+func TestNilHealthStateIsAlwaysAvailable(t *testing.T) {
+	var h *healthState
+	if !h.allowRequest() {
+		t.Fatal("expected a nil healthState to always allow requests")
+	}
+	h.recordResult(true) // must not panic
+}
+
+func TestProbeOnceTogglesAliveAtConfiguredThresholds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start a local listener: %v", err)
+	}
+
+	s := &Server{URL: ln.Addr().String()}
+	s.Alive.Store(true)
+	s.health = newHealthState(s, HealthCheckConfig{
+		Type:          "tcp",
+		RiseThreshold: 2,
+		FallThreshold: 2,
+	}, CircuitBreakerConfig{})
+
+	ln.Close() // backend now unreachable
+
+	s.health.probeOnce()
+	if !s.Alive.Load() {
+		t.Fatal("expected a single failed probe to not yet flip Alive, since fallThreshold is 2")
+	}
+
+	s.health.probeOnce()
+	if s.Alive.Load() {
+		t.Fatal("expected a second consecutive failed probe to flip Alive to false")
+	}
+}
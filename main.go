@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -23,31 +24,89 @@ type Config struct {
 		DirPath                  string `yaml:"dirPath"`
 		ReceivePath              string `yaml:"receivePath"`
 		CheckAvailabilityTimeout int    `yaml:"checkAvailabilityTimeout"`
+		LogFormat                string `yaml:"logFormat"`
+		MetricsPort              int    `yaml:"metricsPort"`
+		// AllowedMethods restricts which HTTP methods proxyHandler accepts.
+		// voidension only exposes one proxied route (ReceivePath), so this
+		// is a single global allowlist rather than per-route config; an
+		// empty list (the default) admits every method.
+		AllowedMethods []string `yaml:"allowedMethods"`
+		MaxBodyBytes   int64    `yaml:"maxBodyBytes"`
 	} `yaml:"app"`
 	Incoming struct {
-		AllowedIPs []string `yaml:"allowedIPs"`
+		AllowedIPs     []string  `yaml:"allowedIPs"`
+		TrustedProxies []string  `yaml:"trustedProxies"`
+		Auth           string    `yaml:"auth"`
+		TLS            TLSConfig `yaml:"tls"`
 	} `yaml:"incoming"`
 	Outgoing struct {
-		ServerPostURLs []string `yaml:"serverPostURLs"`
+		Strategy       string               `yaml:"strategy"`
+		HashHeader     string               `yaml:"hashHeader"`
+		Servers        []ServerConfig       `yaml:"servers"`
+		CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+		Retry          RetryConfig          `yaml:"retry"`
 	} `yaml:"outgoing"`
 }
 
+// ServerConfig describes one backend entry under outgoing.servers.
+type ServerConfig struct {
+	URL         string            `yaml:"url"`
+	Weight      int               `yaml:"weight"`
+	HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+}
+
 type Server struct {
-	URL    string
-	Locked bool
-	Alive  bool
+	URL string
+
+	// Alive is read on every proxied request and written by the
+	// health-check goroutine concurrently, so it's an atomic.Bool rather
+	// than a plain bool guarded by mu.
+	Alive atomic.Bool
+
+	// activeConns tracks in-flight requests on this backend; read and
+	// written atomically since balancers and the proxy handler touch it
+	// from multiple goroutines without holding mu.
+	activeConns int64
+	// Weight is the relative share of traffic this server should receive
+	// under the weighted and consistent-hash strategies. Zero and
+	// negative values are treated as 1.
+	Weight int
+
+	// health tracks probe results and the live-traffic circuit breaker
+	// for this backend (see health.go).
+	health *healthState
+}
+
+func (s *Server) available() bool {
+	return s != nil && s.Alive.Load() && s.health.allowRequest()
+}
+
+func (s *Server) weight() int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+func (s *Server) acquire() {
+	atomic.AddInt64(&s.activeConns, 1)
+}
+
+func (s *Server) release() {
+	atomic.AddInt64(&s.activeConns, -1)
 }
 
 var (
-	config        Config
-	serverPool    []*Server
-	mu            sync.Mutex
-	requestQueue  = make(chan *http.Request, 100)
-	responseQueue = make(chan *http.Response, 100)
-	InfoLog       *log.Logger
-	WarnLog       *log.Logger
-	ErrorLog      *log.Logger
-	AccessLog     *log.Logger
+	config       Config
+	serverPool   []*Server
+	balancer     Balancer
+	authBackend  Auth
+	mu           sync.Mutex
+	reverseProxy *httputil.ReverseProxy
+	InfoLog      *Logger
+	WarnLog      *Logger
+	ErrorLog     *Logger
+	AccessLog    *Logger
 )
 
 func initDir(config *Config) {
@@ -75,10 +134,15 @@ func initLoggers(config *Config) {
 	logWriter := io.MultiWriter(logFile, os.Stdout)
 	accessLogWriter := io.MultiWriter(accessLogFile, os.Stdout)
 
-	InfoLog = log.New(logWriter, "V: INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	WarnLog = log.New(logWriter, "V: WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLog = log.New(logWriter, "V: ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	AccessLog = log.New(accessLogWriter, "V: ACCESS: ", log.Ldate|log.Ltime|log.Lshortfile)
+	format := config.App.LogFormat
+	if format != "json" {
+		format = "text"
+	}
+
+	InfoLog = newLogger(LevelInfo, logWriter, format)
+	WarnLog = newLogger(LevelWarn, logWriter, format)
+	ErrorLog = newLogger(LevelError, logWriter, format)
+	AccessLog = newLogger(LevelAccess, accessLogWriter, format)
 
 	InfoLog.Println("Voidension started")
 }
@@ -95,114 +159,66 @@ func loadConfig(configPath string) {
 	}
 }
 
-func initServerPool() {
-	for _, url := range config.Outgoing.ServerPostURLs {
-		serverPool = append(serverPool, &Server{URL: url, Locked: false, Alive: true})
+func initAuth(config *Config) {
+	backend, err := newAuth(config.Incoming.Auth)
+	if err != nil {
+		ErrorLog.Fatalf("Failed to initialize auth backend: %v", err)
 	}
+	authBackend = backend
 }
 
-func findAvailableServer() *Server {
-	mu.Lock()
-	defer mu.Unlock()
-	for _, server := range serverPool {
-		if server.Alive && !server.Locked {
-			server.Locked = true
-			return server
-		}
+func initServerPool() {
+	for _, sc := range config.Outgoing.Servers {
+		server := &Server{URL: sc.URL, Weight: sc.Weight}
+		server.Alive.Store(true)
+		server.health = newHealthState(server, sc.HealthCheck, config.Outgoing.CircuitBreaker)
+		serverPool = append(serverPool, server)
 	}
-	return nil
+	balancer = newBalancer(&config)
+	reverseProxy = newReverseProxy()
 }
 
-func unlockServer(server *Server) {
+// findAvailableServer asks the configured balancer for a backend and marks
+// it as carrying one more in-flight request. Callers must pair a non-nil
+// result with a call to unlockServer once the request completes.
+func findAvailableServer(r *http.Request) *Server {
 	mu.Lock()
-	defer mu.Unlock()
-	server.Locked = false
-}
-
-func forwardRequest(req *http.Request, server *Server) {
-	client := &http.Client{Timeout: 10 * time.Second}
+	pool := make([]*Server, len(serverPool))
+	copy(pool, serverPool)
+	mu.Unlock()
 
-	bodyBytes, err := io.ReadAll(req.Body)
-	if err != nil {
-		ErrorLog.Printf("Failed to read request body: %v", err)
-		http.Error(nil, "Failed to read request body", http.StatusInternalServerError)
-		unlockServer(server)
-		return
-	}
-
-	newReq, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		ErrorLog.Printf("Failed to create new request to %s: %v", server.URL, err)
-		http.Error(nil, "Failed to create request", http.StatusInternalServerError)
-		unlockServer(server)
-		return
-	}
-
-	newReq.Header = req.Header
-
-	resp, err := client.Do(newReq)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			WarnLog.Printf("Server %s timed out: %v", server.URL, err)
-		} else {
-			ErrorLog.Printf("Server %s error: %v", server.URL, err)
-		}
-		http.Error(nil, "Server error", http.StatusBadGateway)
-		unlockServer(server)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 500 {
-		ErrorLog.Printf("Server %s returned error status: %d", server.URL, resp.StatusCode)
-		http.Error(nil, "Server error", http.StatusBadGateway)
-		unlockServer(server)
-		return
-	}
-
-	responseQueue <- resp
-}
-
-func handleRequests() {
-	for req := range requestQueue {
-		go func(req *http.Request) {
-			for {
-				server := findAvailableServer()
-				if server != nil {
-					forwardRequest(req, server)
-					break
-				} else {
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
-		}(req)
+	server := balancer.Select(pool, r)
+	if server != nil {
+		server.acquire()
 	}
+	return server
 }
 
-func isIPAllowed(ip string) bool {
-	if len(config.Incoming.AllowedIPs) == 0 {
-		return true
-	}
-
-	for _, allowedIP := range config.Incoming.AllowedIPs {
-		if ip == allowedIP {
-			return true
-		}
-	}
-	return false
+// unlockServer releases the in-flight slot acquired by findAvailableServer
+// and feeds the request outcome into the server's circuit breaker.
+func unlockServer(server *Server, failed bool) {
+	server.release()
+	server.health.recordResult(failed)
 }
 
+// proxyHandler runs the shared checks (method allowlist, IP allowlist,
+// auth) then hands the request to reverseProxy, which picks a backend,
+// streams the request/response bodies without buffering, and supports
+// WebSocket/SSE upgrades via httputil.ReverseProxy. The actual forwarding,
+// metrics, and access logging happen in proxy.go once a backend is known.
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+	if !methodAllowed(r.Method) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	remoteIP := r.Header.Get("X-Real-IP")
-	currentIP := r.RemoteAddr
-	if remoteIP == "" {
-		remoteIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newRequestID()
 	}
+	r.Header.Set("X-Request-ID", requestID)
+
+	remoteIP, _ := resolveClientIP(r)
 
 	if !isIPAllowed(remoteIP) {
 		WarnLog.Printf("Denied request from IP: %s", remoteIP)
@@ -210,94 +226,48 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	AccessLog.Printf("Received request from %s to %s", remoteIP, r.URL.String())
-
-	server := findAvailableServer()
-	if server == nil {
-		requestQueue <- r
-		return
-	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		ErrorLog.Printf("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-		return
-	}
-
-	newReq, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		ErrorLog.Printf("Failed to create new request to %s: %v", server.URL, err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-
-	newReq.Header = make(http.Header)
-	for key, values := range r.Header {
-		newReq.Header[key] = values
-	}
-
-	currentXFF := r.Header.Get("X-Forwarded-For")
-	if currentXFF == "" {
-		currentXFF = remoteIP
-	}
-
-	newReq.Header.Del("X-Forwarded-For")
-	newReq.Header.Add("X-Forwarded-For", currentXFF+","+currentIP)
-	newReq.Header.Add("X-Real-IP", remoteIP)
-
-	resp, err := client.Do(newReq)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			WarnLog.Printf("Server %s timed out: %v", server.URL, err)
-		} else {
-			ErrorLog.Printf("Server %s error: %v", server.URL, err)
-		}
-		http.Error(w, "Server error", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	unlockServer(server)
-
-	if resp.StatusCode >= 500 {
-		ErrorLog.Printf("Server %s returned error status: %d", server.URL, resp.StatusCode)
-		http.Error(w, "Server error", http.StatusBadGateway)
+	if !authBackend.Authenticate(w, r) {
+		authFailuresTotal.Inc()
+		WarnLog.Printf("Denied unauthenticated request from IP: %s", remoteIP)
 		return
 	}
+	r.Header.Del("Proxy-Authorization")
 
-	AccessLog.Printf("Forwarded request to %s returned status %d", server.URL, resp.StatusCode)
-
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if config.App.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, config.App.MaxBodyBytes)
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	reqBody := &countingBody{ReadCloser: r.Body}
+	r.Body = reqBody
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, ctxKeyRequestID, requestID)
+	ctx = context.WithValue(ctx, ctxKeyRemoteIP, remoteIP)
+	ctx = context.WithValue(ctx, ctxKeyStart, time.Now())
+	ctx = context.WithValue(ctx, ctxKeyReqBody, reqBody)
+	r = r.WithContext(ctx)
+
+	w.Header().Set("X-Request-ID", requestID)
+
+	AccessLog.Fields("Received request", map[string]interface{}{
+		"remote_ip":  remoteIP,
+		"request_id": requestID,
+		"method":     r.Method,
+		"path":       r.URL.String(),
+	})
+
+	reverseProxy.ServeHTTP(w, r)
 }
 
 func checkServerAvailability() {
 	for {
 		mu.Lock()
-		for _, server := range serverPool {
-			go func(s *Server) {
-				hostPort := extractHostPort(s.URL)
-
-				conn, err := net.DialTimeout("tcp", hostPort, 5*time.Second)
-				if err != nil {
-					s.Alive = false
-					WarnLog.Printf("Server %s is down: %v", s.URL, err)
-				} else {
-					s.Alive = true
-					conn.Close()
-					InfoLog.Printf("Server %s is up", s.URL)
-				}
-			}(server)
-		}
+		pool := make([]*Server, len(serverPool))
+		copy(pool, serverPool)
 		mu.Unlock()
+
+		for _, server := range pool {
+			go server.health.maybeProbe()
+		}
 		time.Sleep(time.Duration(config.App.CheckAvailabilityTimeout) * time.Millisecond)
 	}
 }
@@ -314,18 +284,46 @@ func extractHostPort(url string) string {
 
 func main() {
 	var configPath string
+	var listCiphersFlag bool
 	flag.StringVar(&configPath, "config", "config.yaml", "Path to the YAML configuration file")
+	flag.BoolVar(&listCiphersFlag, "list-ciphers", false, "List supported TLS cipher suite names and exit")
 	flag.Parse()
 
+	if listCiphersFlag {
+		listCiphers()
+		return
+	}
+
 	loadConfig(configPath)
 	initDir(&config)
 	initLoggers(&config)
+	initAllowlists(&config)
+	initAuth(&config)
 	initServerPool()
 
 	http.HandleFunc(config.App.ReceivePath, proxyHandler)
-	go handleRequests()
+	http.HandleFunc("/stats", statsHandler)
 	go checkServerAvailability()
 
+	if config.App.MetricsPort != 0 {
+		startMetricsCollector()
+		startMetricsServer(fmt.Sprintf(":%d", config.App.MetricsPort))
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.App.Port)}
+
+	tlsCfg, err := buildTLSConfig(config.Incoming.TLS)
+	if err != nil {
+		ErrorLog.Fatalf("Invalid incoming.tls configuration: %v", err)
+	}
+
+	if tlsCfg != nil {
+		server.TLSConfig = tlsCfg
+		InfoLog.Printf("Starting the load balancer on port %d (TLS)", config.App.Port)
+		ErrorLog.Fatal(server.ListenAndServeTLS(config.Incoming.TLS.CertFile, config.Incoming.TLS.KeyFile))
+		return
+	}
+
 	InfoLog.Printf("Starting the load balancer on port %d", config.App.Port)
-	ErrorLog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.App.Port), nil))
+	ErrorLog.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voidension_requests_total",
+		Help: "Total proxied requests, by backend and response status.",
+	}, []string{"backend", "status"})
+
+	requestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "voidension_request_duration_seconds",
+		Help:    "End-to-end request latency as observed by the proxy handler.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "voidension_backend_duration_seconds",
+		Help:    "Per-backend upstream request latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	poolSizeGauge        = prometheus.NewGauge(prometheus.GaugeOpts{Name: "voidension_pool_size", Help: "Configured backend count."})
+	poolAliveGauge       = prometheus.NewGauge(prometheus.GaugeOpts{Name: "voidension_pool_alive", Help: "Backends currently marked alive."})
+	poolActiveConnsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "voidension_pool_active_conns", Help: "In-flight requests across the pool."})
+
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "voidension_circuit_breaker_state",
+		Help: "Circuit breaker state per backend (0=closed, 1=half-open, 2=open).",
+	}, []string{"backend"})
+
+	authFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "voidension_auth_failures_total",
+		Help: "Requests rejected by the configured auth backend.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		backendDuration,
+		poolSizeGauge,
+		poolAliveGauge,
+		poolActiveConnsGauge,
+		breakerStateGauge,
+		authFailuresTotal,
+	)
+}
+
+// startMetricsCollector periodically refreshes the pool-level gauges,
+// which reflect shared state rather than a single request.
+func startMetricsCollector() {
+	go func() {
+		for {
+			refreshPoolGauges()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func refreshPoolGauges() {
+	mu.Lock()
+	pool := make([]*Server, len(serverPool))
+	copy(pool, serverPool)
+	mu.Unlock()
+
+	alive := 0
+	var activeConns int64
+	for _, s := range pool {
+		if s.Alive.Load() {
+			alive++
+		}
+		activeConns += atomic.LoadInt64(&s.activeConns)
+
+		state, _ := s.health.snapshot()
+		breakerStateGauge.WithLabelValues(s.URL).Set(breakerStateValue(state))
+	}
+
+	poolSizeGauge.Set(float64(len(pool)))
+	poolAliveGauge.Set(float64(alive))
+	poolActiveConnsGauge.Set(float64(activeConns))
+}
+
+func breakerStateValue(state string) float64 {
+	switch state {
+	case "open":
+		return 2
+	case "half-open":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// startMetricsServer exposes /metrics on its own listener, separate from
+// the proxy's incoming port, as Prometheus scraping shouldn't share a port
+// with proxied traffic.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	InfoLog.Printf("Starting metrics listener on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			ErrorLog.Fatalf("Metrics listener failed: %v", err)
+		}
+	}()
+}
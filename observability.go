@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogLevel identifies which of the four log streams a record belongs to.
+type LogLevel int
+
+const (
+	LevelInfo LogLevel = iota
+	LevelWarn
+	LevelError
+	LevelAccess
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelWarn:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	case LevelAccess:
+		return "ACCESS"
+	default:
+		return "INFO"
+	}
+}
+
+// Logger is a small leveled logger with two output formats: "text", which
+// matches voidension's original human-readable "V: LEVEL: ..." lines, and
+// "json", which emits one structured object per line. Fields passed to
+// Fields() are merged into the JSON object, or appended as key=value pairs
+// in text mode.
+type Logger struct {
+	level  LogLevel
+	out    io.Writer
+	format string
+
+	mu sync.Mutex
+}
+
+func newLogger(level LogLevel, out io.Writer, format string) *Logger {
+	return &Logger{level: level, out: out, format: format}
+}
+
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.write(fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Println(args ...interface{}) {
+	l.write(fmt.Sprintln(args...), nil)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.write(fmt.Sprintf(format, args...), nil)
+	os.Exit(1)
+}
+
+func (l *Logger) Fatal(args ...interface{}) {
+	l.write(fmt.Sprint(args...), nil)
+	os.Exit(1)
+}
+
+// Fields logs msg with structured key/value pairs attached, used for
+// access-log entries (remote_ip, backend, status, latency_ms, ...).
+func (l *Logger) Fields(msg string, fields map[string]interface{}) {
+	l.write(msg, fields)
+}
+
+func (l *Logger) write(msg string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	if l.format == "json" {
+		record := make(map[string]interface{}, len(fields)+3)
+		record["time"] = now.Format(time.RFC3339Nano)
+		record["level"] = l.level.String()
+		record["msg"] = msg
+		for k, v := range fields {
+			record[k] = v
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			fmt.Fprintf(l.out, "V: ERROR: failed to marshal log record: %v\n", err)
+			return
+		}
+		fmt.Fprintln(l.out, string(data))
+		return
+	}
+
+	line := fmt.Sprintf("V: %s: %s %s", l.level.String(), now.Format("2006/01/02 15:04:05"), msg)
+	for k, v := range fields {
+		line += fmt.Sprintf(" %s=%v", k, v)
+	}
+	fmt.Fprintln(l.out, line)
+}
+
+// newRequestID generates a random UUIDv4 for X-Request-ID propagation.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("fallback-%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	ctxKeyServer ctxKey = iota
+	ctxKeyRequestID
+	ctxKeyRemoteIP
+	ctxKeyStart
+	ctxKeyReqBody
+)
+
+var errNoBackendAvailable = errors.New("no backend available")
+
+// proxyTransport is shared across requests so TCP/TLS connections to
+// backends are reused instead of being rebuilt per request, as with the
+// old per-call http.Client.
+var proxyTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// balancedTransport fails a request outright when Director couldn't find
+// an available backend, instead of letting it dial an unset/zero URL.
+type balancedTransport struct {
+	wrapped http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if server, _ := req.Context().Value(ctxKeyServer).(*Server); server == nil {
+		return nil, errNoBackendAvailable
+	}
+	return t.wrapped.RoundTrip(req)
+}
+
+// countingBody wraps a response or request body to count bytes streamed
+// through it, invoking onClose once the stream is fully read and closed.
+type countingBody struct {
+	io.ReadCloser
+	n       int64
+	onClose func(n int64)
+	closed  bool
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingBody) Close() error {
+	err := c.ReadCloser.Close()
+	if !c.closed {
+		c.closed = true
+		if c.onClose != nil {
+			c.onClose(c.n)
+		}
+	}
+	return err
+}
+
+// newReverseProxy builds the streaming httputil.ReverseProxy that replaces
+// the old read-everything-into-memory forwarding path. Director selects the
+// first backend via the balancer; retryTransport re-selects a different one
+// for retried or hedged attempts (see retry.go), and balancedTransport turns
+// "no backend available" into a clean error instead of a bad dial.
+//
+// WebSocket/SSE passthrough and request/response streaming come from the
+// stdlib: httputil.ReverseProxy hijacks the client connection and copies
+// bytes in both directions whenever the backend answers a "Connection:
+// Upgrade" request with a matching 101 response, and otherwise copies
+// body bytes as they arrive rather than buffering the whole message.
+func newReverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:       proxyDirector,
+		Transport:      &retryTransport{wrapped: &balancedTransport{wrapped: proxyTransport}},
+		ModifyResponse: proxyModifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+}
+
+func proxyDirector(req *http.Request) {
+	server := findAvailableServer(req)
+	ctx := context.WithValue(req.Context(), ctxKeyServer, server)
+	*req = *req.WithContext(ctx)
+
+	if server == nil {
+		return
+	}
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		ErrorLog.Printf("Invalid backend URL %s: %v", server.URL, err)
+		return
+	}
+
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = target.Path
+	req.URL.RawPath = target.RawPath
+	req.URL.RawQuery = target.RawQuery
+	req.Host = target.Host
+
+	remoteIP, _ := req.Context().Value(ctxKeyRemoteIP).(string)
+	directIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if directIP == "" {
+		directIP = req.RemoteAddr
+	}
+
+	req.Header.Set("X-Real-IP", remoteIP)
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		req.Header.Set("X-Forwarded-For", xff+","+directIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", remoteIP+","+directIP)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("Forwarded", fmt.Sprintf("for=%s;proto=%s;host=%s", directIP, proto, req.Host))
+}
+
+func proxyModifyResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// handleUpgradeResponse type-asserts resp.Body to io.ReadWriteCloser
+		// to splice the raw backend connection for the WebSocket/SSE
+		// upgrade; wrapping it in countingBody (which embeds io.ReadCloser
+		// only) would fail that assertion and turn every upgrade into a 502.
+		// There's no stream left to count bytes on once it's handed off, so
+		// just record the outcome now.
+		recordProxyOutcome(resp.Request, resp.StatusCode, 0, nil)
+		return nil
+	}
+
+	body := resp.Body
+	resp.Body = &countingBody{
+		ReadCloser: body,
+		onClose: func(n int64) {
+			recordProxyOutcome(resp.Request, resp.StatusCode, n, nil)
+		},
+	}
+	return nil
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	recordProxyOutcome(r, 0, 0, err)
+
+	if errors.Is(err, errNoBackendAvailable) {
+		http.Error(w, "No backend available", http.StatusServiceUnavailable)
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		WarnLog.Printf("Backend request timed out: %v", err)
+	} else {
+		ErrorLog.Printf("Backend request failed: %v", err)
+	}
+	http.Error(w, "Server error", http.StatusBadGateway)
+}
+
+// recordProxyOutcome releases the backend's in-flight slot, feeds the
+// circuit breaker, and logs the attempt that actually answered the client.
+// statusCode/bytesOut are zero on hard transport errors, where
+// roundTripErr is non-nil.
+func recordProxyOutcome(r *http.Request, statusCode int, bytesOut int64, roundTripErr error) {
+	server, _ := r.Context().Value(ctxKeyServer).(*Server)
+	if server == nil {
+		return
+	}
+
+	failed := roundTripErr != nil || statusCode >= 500
+	unlockServer(server, failed)
+	logProxyOutcome(r, server, statusCode, bytesOut, roundTripErr, false)
+}
+
+// logProxyOutcome updates metrics and writes the access-log line for one
+// proxied attempt, terminal or not. It doesn't touch the backend's
+// in-flight slot: recordProxyOutcome releases it for the attempt that was
+// actually returned to the client, while retry.go releases it directly for
+// an intermediate attempt it's abandoning, since those are always treated
+// as failed for the circuit breaker regardless of the configured
+// retryableStatuses. retried marks the latter case so it's distinguishable
+// in the access log from the attempt that ultimately answered the client.
+func logProxyOutcome(r *http.Request, server *Server, statusCode int, bytesOut int64, roundTripErr error, retried bool) {
+	status := "error"
+	if roundTripErr == nil {
+		status = fmt.Sprintf("%d", statusCode)
+	}
+	requestsTotal.WithLabelValues(server.URL, status).Inc()
+
+	requestID, _ := r.Context().Value(ctxKeyRequestID).(string)
+	remoteIP, _ := r.Context().Value(ctxKeyRemoteIP).(string)
+	fields := map[string]interface{}{
+		"remote_ip":  remoteIP,
+		"backend":    server.URL,
+		"status":     status,
+		"request_id": requestID,
+		"bytes_out":  bytesOut,
+	}
+	if retried {
+		fields["retried"] = true
+	}
+	if reqBody, ok := r.Context().Value(ctxKeyReqBody).(*countingBody); ok {
+		fields["bytes_in"] = reqBody.n
+	}
+	if start, ok := r.Context().Value(ctxKeyStart).(time.Time); ok {
+		latency := time.Since(start)
+		fields["latency_ms"] = latency.Milliseconds()
+		backendDuration.WithLabelValues(server.URL).Observe(latency.Seconds())
+		// requestDuration is the client-facing end-to-end latency; only the
+		// attempt actually returned to the client should feed it.
+		if !retried {
+			requestDuration.Observe(latency.Seconds())
+		}
+	}
+
+	AccessLog.Fields("Forwarded request", fields)
+}
+
+// methodAllowed checks r.Method against app.allowedMethods. An empty list
+// (the default) admits every method, matching the streaming proxy's goal
+// of passing through GET/PUT/DELETE/etc.; an operator can still restrict
+// to POST-only by setting the list explicitly. This is one allowlist for
+// the single route voidension exposes (app.receivePath), not a per-route
+// config — there's only one route to allowlist.
+func methodAllowed(method string) bool {
+	if len(config.App.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range config.App.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
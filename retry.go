@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultMaxBufferBytes caps how much of a request body retryTransport will
+// buffer for replay when outgoing.retry.maxBufferBytes is left unset.
+const defaultMaxBufferBytes = 1 << 20 // 1MiB
+
+// defaultIdempotentMethods is used when outgoing.retry.idempotentMethods is
+// left unset.
+var defaultIdempotentMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+
+// RetryConfig configures retry and hedged-request behavior under
+// outgoing.retry. A request is only eligible when isIdempotentRequest
+// reports true for it; MaxRetries of 0 (the default) disables retry
+// entirely, preserving the single-attempt behavior from before this file
+// existed.
+type RetryConfig struct {
+	MaxRetries        int      `yaml:"maxRetries"`
+	MaxBufferBytes    int64    `yaml:"maxBufferBytes"`
+	RetryableStatuses []int    `yaml:"retryableStatuses"`
+	HedgeAfterMs      int      `yaml:"hedgeAfterMs"`
+	IdempotentMethods []string `yaml:"idempotentMethods"`
+	IdempotentPaths   []string `yaml:"idempotentPaths"`
+}
+
+// retryTransport sits between the reverse proxy and balancedTransport. For
+// requests that aren't idempotent, or whose body is too large to buffer for
+// replay, it degrades to a single attempt identical to pre-retry behavior.
+// For eligible requests it retries connection errors/timeouts and
+// configured 5xx responses against a fresh backend, and, for GETs, hedges
+// by racing a second backend once outgoing.retry.hedgeAfterMs elapses.
+type retryTransport struct {
+	wrapped http.RoundTripper
+}
+
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if server, _ := req.Context().Value(ctxKeyServer).(*Server); server == nil {
+		return nil, errNoBackendAvailable
+	}
+	return t.wrapped.RoundTrip(req)
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := config.Outgoing.Retry
+	if cfg.MaxRetries <= 0 || !isIdempotentRequest(req) {
+		return t.attempt(req)
+	}
+
+	bodyBytes, bufferable := bufferBody(req, cfg.MaxBufferBytes)
+	if !bufferable {
+		return t.attempt(req)
+	}
+
+	tried := map[string]bool{}
+	attemptReq := req
+
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		var err error
+		var winner *http.Request
+		if attempt == 0 && cfg.HedgeAfterMs > 0 && req.Method == http.MethodGet {
+			resp, err, winner = t.hedgedAttempt(attemptReq, bodyBytes, tried, time.Duration(cfg.HedgeAfterMs)*time.Millisecond)
+		} else {
+			resp, err = t.attempt(attemptReq)
+			winner = attemptReq
+		}
+
+		server, _ := winner.Context().Value(ctxKeyServer).(*Server)
+		if server != nil {
+			tried[server.URL] = true
+		}
+
+		if !retryable(resp, err, cfg) || attempt >= cfg.MaxRetries {
+			// req is the same *http.Request object httputil.ReverseProxy
+			// holds as outreq. On success, resp.Request already carries
+			// the right context since the stdlib Transport set it to
+			// whatever request it was actually given. But on a hard
+			// transport error there's no *http.Response at all, so
+			// ReverseProxy's ErrorHandler falls back to outreq — rebind
+			// it in place (the same trick proxyDirector already uses) so
+			// it reflects the backend that actually produced this result
+			// instead of whichever was first selected.
+			if err != nil {
+				rebindRequest(req, winner)
+			}
+			return resp, err
+		}
+
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+			resp.Body.Close()
+		}
+		if server != nil {
+			unlockServer(server, true)
+			logProxyOutcome(winner, server, statusCode, 0, err, true)
+		}
+
+		next, rerr := rewriteForRetry(req, tried)
+		if rerr != nil {
+			// This attempt was already unlocked/logged above; detach req
+			// from backend accounting so a caller that inspects it
+			// afterward (proxy.go's ErrorHandler) doesn't process the
+			// same outcome a second time against outreq's original
+			// backend.
+			detachRequestServer(req)
+			return resp, err
+		}
+		setRequestBody(next, bodyBytes)
+		attemptReq = next
+	}
+}
+
+// rebindRequest copies winner's fields (URL, Host, context, ...) onto req
+// in place, the same dereference-assignment trick proxyDirector uses to
+// update outreq. A no-op when winner already is req (the common,
+// non-retried case).
+func rebindRequest(req, winner *http.Request) {
+	if req != winner {
+		*req = *winner
+	}
+}
+
+// detachRequestServer clears ctxKeyServer on req in place so a later
+// ctxKeyServer lookup against it (recordProxyOutcome via ErrorHandler)
+// finds no server and does nothing, instead of re-processing an outcome
+// RoundTrip already unlocked and logged itself.
+func detachRequestServer(req *http.Request) {
+	ctx := context.WithValue(req.Context(), ctxKeyServer, (*Server)(nil))
+	*req = *req.WithContext(ctx)
+}
+
+type hedgeResult struct {
+	resp *http.Response
+	err  error
+}
+
+// hedgedAttempt races primaryReq against a second request to a different
+// backend fired after hedgeAfter has elapsed with no response, returning
+// whichever answers first, the request that produced it, and canceling the
+// other. The loser is drained and released on its own goroutine so the
+// winner isn't held up by it.
+func (t *retryTransport) hedgedAttempt(primaryReq *http.Request, bodyBytes []byte, tried map[string]bool, hedgeAfter time.Duration) (*http.Response, error, *http.Request) {
+	primaryCtx, cancelPrimary := context.WithCancel(primaryReq.Context())
+	primary := primaryReq.WithContext(primaryCtx)
+
+	primaryCh := make(chan hedgeResult, 1)
+	go func() {
+		resp, err := t.attempt(primary)
+		primaryCh <- hedgeResult{resp, err}
+	}()
+
+	select {
+	case r := <-primaryCh:
+		cancelPrimary()
+		return r.resp, r.err, primary
+	case <-time.After(hedgeAfter):
+	}
+
+	hedgeReq, err := rewriteForRetry(primaryReq, tried)
+	if err != nil {
+		cancelPrimary()
+		r := <-primaryCh
+		return r.resp, r.err, primary
+	}
+	setRequestBody(hedgeReq, bodyBytes)
+
+	hedgeCtx, cancelHedge := context.WithCancel(hedgeReq.Context())
+	hedge := hedgeReq.WithContext(hedgeCtx)
+
+	hedgeCh := make(chan hedgeResult, 1)
+	go func() {
+		resp, err := t.attempt(hedge)
+		hedgeCh <- hedgeResult{resp, err}
+	}()
+
+	select {
+	case r := <-primaryCh:
+		cancelPrimary()
+		cancelHedge()
+		go drainLoser(hedgeCh, hedge)
+		return r.resp, r.err, primary
+	case r := <-hedgeCh:
+		cancelHedge()
+		cancelPrimary()
+		go drainLoser(primaryCh, primary)
+		return r.resp, r.err, hedge
+	}
+}
+
+// drainLoser waits for the losing side of a hedge race, releases the
+// backend slot it held, and closes its response body if it ever arrived.
+func drainLoser(ch chan hedgeResult, req *http.Request) {
+	r := <-ch
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+	if server, _ := req.Context().Value(ctxKeyServer).(*Server); server != nil {
+		unlockServer(server, true)
+	}
+}
+
+// retryable reports whether a completed attempt should be retried: any
+// transport-level error, or a response status listed in
+// outgoing.retry.retryableStatuses (5xx by default).
+func retryable(resp *http.Response, err error, cfg RetryConfig) bool {
+	if err != nil {
+		return true
+	}
+	if resp == nil {
+		return false
+	}
+	if len(cfg.RetryableStatuses) == 0 {
+		return resp.StatusCode >= 500
+	}
+	for _, s := range cfg.RetryableStatuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdempotentRequest reports whether req is safe to retry or hedge: its
+// method is in outgoing.retry.idempotentMethods (GET/HEAD/PUT/DELETE by
+// default), or its path is listed under outgoing.retry.idempotentPaths and
+// the client supplied an Idempotency-Key header.
+func isIdempotentRequest(req *http.Request) bool {
+	methods := config.Outgoing.Retry.IdempotentMethods
+	if len(methods) == 0 {
+		methods = defaultIdempotentMethods
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, req.Method) {
+			return true
+		}
+	}
+
+	if req.Header.Get("Idempotency-Key") == "" {
+		return false
+	}
+	for _, p := range config.Outgoing.Retry.IdempotentPaths {
+		if req.URL.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferBody reads req's body into memory, up to maxBytes, so it can be
+// replayed across retry/hedge attempts. ok is false when there's nothing to
+// buffer (no body) or the body exceeds maxBytes; in the latter case req's
+// body is restored (the prefix already read, followed by the unread
+// remainder) so the caller's single pass-through attempt still sees it
+// whole.
+func bufferBody(req *http.Request, maxBytes int64) (data []byte, ok bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBufferBytes
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+	if err != nil {
+		return nil, false
+	}
+	if int64(len(data)) > maxBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return nil, false
+	}
+
+	req.Body.Close()
+	setRequestBody(req, data)
+	return data, true
+}
+
+// setRequestBody points req at a fresh reader over bodyBytes so the same
+// buffered body can be attached to successive retry/hedge attempts.
+func setRequestBody(req *http.Request, bodyBytes []byte) {
+	if bodyBytes == nil {
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	req.ContentLength = int64(len(bodyBytes))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(bodyBytes)), nil
+	}
+}
+
+// rewriteForRetry selects a backend not already in tried, clones req onto a
+// context carrying that backend, and repoints the URL/Host at it the same
+// way proxyDirector does for the first attempt.
+func rewriteForRetry(req *http.Request, tried map[string]bool) (*http.Request, error) {
+	server := findAvailableServerExcluding(req, tried)
+	if server == nil {
+		return nil, errNoBackendAvailable
+	}
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		unlockServer(server, true)
+		return nil, err
+	}
+
+	ctx := context.WithValue(req.Context(), ctxKeyServer, server)
+	next := req.Clone(ctx)
+	next.URL.Scheme = target.Scheme
+	next.URL.Host = target.Host
+	next.URL.Path = target.Path
+	next.URL.RawPath = target.RawPath
+	next.URL.RawQuery = target.RawQuery
+	next.Host = target.Host
+	return next, nil
+}
+
+// findAvailableServerExcluding is findAvailableServer restricted to backends
+// whose URL isn't already in tried, used to pick a different server for a
+// retry or hedge attempt.
+func findAvailableServerExcluding(r *http.Request, tried map[string]bool) *Server {
+	mu.Lock()
+	pool := make([]*Server, 0, len(serverPool))
+	for _, s := range serverPool {
+		if !tried[s.URL] {
+			pool = append(pool, s)
+		}
+	}
+	mu.Unlock()
+
+	server := balancer.Select(pool, r)
+	if server != nil {
+		server.acquire()
+	}
+	return server
+}
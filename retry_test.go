@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTestServerPool points the package-level serverPool/balancer/config at
+// a fresh pool of backends for one test and restores the previous globals
+// on cleanup, since retryTransport reads all three as package state.
+func withTestServerPool(t *testing.T, backends []*httptest.Server, retryCfg RetryConfig) []*Server {
+	t.Helper()
+
+	prevPool, prevBalancer, prevConfig := serverPool, balancer, config
+
+	pool := make([]*Server, len(backends))
+	for i, b := range backends {
+		s := &Server{URL: b.URL, Weight: 1}
+		s.Alive.Store(true)
+		s.health = newHealthState(s, HealthCheckConfig{}, CircuitBreakerConfig{})
+		pool[i] = s
+	}
+
+	serverPool = pool
+	balancer = &roundRobinBalancer{}
+	config = Config{}
+	config.Outgoing.Retry = retryCfg
+
+	t.Cleanup(func() {
+		serverPool, balancer, config = prevPool, prevBalancer, prevConfig
+	})
+
+	return pool
+}
+
+// pointAt mimics what proxyDirector does for the first attempt: repoint the
+// request at server and stash it on the context retryTransport reads.
+func pointAt(req *http.Request, server *Server) *http.Request {
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.Host = target.Host
+	req.RequestURI = ""
+	return req.WithContext(context.WithValue(req.Context(), ctxKeyServer, server))
+}
+
+func TestRetryTransportRetriesAfter5xxThenSucceeds(t *testing.T) {
+	var failingCalls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	pool := withTestServerPool(t, []*httptest.Server{failing, healthy}, RetryConfig{MaxRetries: 1})
+
+	rt := &retryTransport{wrapped: &balancedTransport{wrapped: http.DefaultTransport}}
+	req := pointAt(httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil), pool[0])
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retried request to land on the healthy backend with 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if atomic.LoadInt32(&failingCalls) != 1 {
+		t.Fatalf("expected exactly one call to the failing backend, got %d", failingCalls)
+	}
+}
+
+func TestRetryTransportGivesUpAfterMaxRetries(t *testing.T) {
+	var calls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	alsoFailing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer alsoFailing.Close()
+
+	pool := withTestServerPool(t, []*httptest.Server{failing, alsoFailing}, RetryConfig{MaxRetries: 1})
+
+	rt := &retryTransport{wrapped: &balancedTransport{wrapped: http.DefaultTransport}}
+	req := pointAt(httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil), pool[0])
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the final exhausted attempt's 500 to be returned, got %d", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected exactly MaxRetries+1=2 backend calls, got %d", calls)
+	}
+}
+
+func TestRetryTransportDoesNotRetryNonIdempotentMethod(t *testing.T) {
+	var calls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	pool := withTestServerPool(t, []*httptest.Server{failing, healthy}, RetryConfig{MaxRetries: 1})
+
+	rt := &retryTransport{wrapped: &balancedTransport{wrapped: http.DefaultTransport}}
+	req := pointAt(httptest.NewRequest(http.MethodPost, "http://placeholder/path", strings.NewReader("body")), pool[0])
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the single POST attempt's 500 to be returned unretried, got %d", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected exactly one call, since POST isn't idempotent by default, got %d", calls)
+	}
+}
+
+func TestRetryTransportReplaysBufferedBodyOnRetry(t *testing.T) {
+	var failingCalls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	var receivedBody string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		receivedBody = string(b)
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	pool := withTestServerPool(t, []*httptest.Server{failing, healthy}, RetryConfig{
+		MaxRetries:        1,
+		IdempotentMethods: []string{http.MethodPost},
+	})
+
+	rt := &retryTransport{wrapped: &balancedTransport{wrapped: http.DefaultTransport}}
+	req := pointAt(httptest.NewRequest(http.MethodPost, "http://placeholder/path", strings.NewReader("payload")), pool[0])
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retried POST to succeed on the healthy backend, got %d", resp.StatusCode)
+	}
+	if receivedBody != "payload" {
+		t.Fatalf("expected the buffered body to be replayed verbatim, got %q", receivedBody)
+	}
+	if atomic.LoadInt32(&failingCalls) != 1 {
+		t.Fatalf("expected exactly one call to the failing backend, got %d", failingCalls)
+	}
+}
+
+func TestRetryTransportHedgeReturnsFasterBackend(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	pool := withTestServerPool(t, []*httptest.Server{slow, fast}, RetryConfig{
+		MaxRetries:   1,
+		HedgeAfterMs: 20,
+	})
+
+	rt := &retryTransport{wrapped: &balancedTransport{wrapped: http.DefaultTransport}}
+	req := pointAt(httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil), pool[0])
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "fast" {
+		t.Fatalf("expected the hedge to win with the fast backend's response, got %q", body)
+	}
+	if elapsed >= 200*time.Millisecond {
+		t.Fatalf("expected the hedge to return well before the slow backend answers, took %s", elapsed)
+	}
+
+	winnerServer, _ := resp.Request.Context().Value(ctxKeyServer).(*Server)
+	if winnerServer != pool[1] {
+		t.Fatalf("expected the winning response's request to carry the fast backend (%s) in its context, got %v", pool[1].URL, winnerServer)
+	}
+}
+
+func TestIsIdempotentRequest(t *testing.T) {
+	prevConfig := config
+	defer func() { config = prevConfig }()
+	config = Config{}
+
+	get := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	if !isIdempotentRequest(get) {
+		t.Fatal("expected GET to be idempotent by default")
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "http://placeholder/path", nil)
+	if isIdempotentRequest(post) {
+		t.Fatal("expected POST to not be idempotent by default")
+	}
+
+	config.Outgoing.Retry.IdempotentPaths = []string{"/checkout"}
+	postCheckout := httptest.NewRequest(http.MethodPost, "http://placeholder/checkout", nil)
+	if isIdempotentRequest(postCheckout) {
+		t.Fatal("expected POST /checkout without an Idempotency-Key to still not be idempotent")
+	}
+	postCheckout.Header.Set("Idempotency-Key", "abc-123")
+	if !isIdempotentRequest(postCheckout) {
+		t.Fatal("expected POST /checkout with an Idempotency-Key to be idempotent")
+	}
+}
+
+func TestRetryableRespectsConfiguredStatuses(t *testing.T) {
+	cfg := RetryConfig{}
+	if !retryable(&http.Response{StatusCode: http.StatusInternalServerError}, nil, cfg) {
+		t.Fatal("expected 500 to be retryable by default")
+	}
+	if retryable(&http.Response{StatusCode: http.StatusTooManyRequests}, nil, cfg) {
+		t.Fatal("expected 429 to not be retryable by default")
+	}
+
+	cfg.RetryableStatuses = []int{http.StatusTooManyRequests}
+	if !retryable(&http.Response{StatusCode: http.StatusTooManyRequests}, nil, cfg) {
+		t.Fatal("expected 429 to be retryable once configured in RetryableStatuses")
+	}
+	if retryable(&http.Response{StatusCode: http.StatusInternalServerError}, nil, cfg) {
+		t.Fatal("expected 500 to no longer be retryable once RetryableStatuses only lists 429")
+	}
+
+	if !retryable(nil, context.DeadlineExceeded, cfg) {
+		t.Fatal("expected a transport error to always be retryable")
+	}
+}
+
+func TestBufferBodyCapsAtMaxBytesAndRestoresRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://placeholder/path", strings.NewReader("0123456789"))
+
+	data, ok := bufferBody(req, 4)
+	if ok {
+		t.Fatal("expected bufferBody to report not-bufferable when the body exceeds maxBytes")
+	}
+	if data != nil {
+		t.Fatalf("expected no buffered data when over the cap, got %q", data)
+	}
+
+	remaining, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading restored body: %v", err)
+	}
+	if string(remaining) != "0123456789" {
+		t.Fatalf("expected the restored body to be readable in full, got %q", remaining)
+	}
+}
+
+func TestBufferBodyReturnsDataWithinCap(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://placeholder/path", strings.NewReader("hello"))
+
+	data, ok := bufferBody(req, 1<<20)
+	if !ok {
+		t.Fatal("expected bufferBody to succeed within the cap")
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected buffered data %q, got %q", "hello", data)
+	}
+
+	replayed, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading req.Body after buffering: %v", err)
+	}
+	if string(replayed) != "hello" {
+		t.Fatalf("expected req.Body to still be readable after buffering, got %q", replayed)
+	}
+}
+
+// TestReverseProxyReleasesBothBackendsOnExhaustedTransportError drives
+// retryTransport through a real httputil.ReverseProxy, the way main.go
+// does, instead of calling RoundTrip directly. When the last attempt fails
+// with a transport-level error (no *http.Response at all), ReverseProxy's
+// ErrorHandler is invoked with outreq — the request object Director
+// originally stamped with the first-selected backend, not whichever
+// backend actually produced the final error — so this is the only way to
+// exercise that divergence.
+func TestReverseProxyReleasesBothBackendsOnExhaustedTransportError(t *testing.T) {
+	deadA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	pool := withTestServerPool(t, []*httptest.Server{deadA, deadB}, RetryConfig{MaxRetries: 1})
+	deadA.Close()
+	deadB.Close()
+
+	rp := &httputil.ReverseProxy{
+		Director:       proxyDirector,
+		Transport:      &retryTransport{wrapped: &balancedTransport{wrapped: proxyTransport}},
+		ModifyResponse: proxyModifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyRequestID, "test-req"))
+	rec := httptest.NewRecorder()
+
+	rp.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected a 502 once both dead backends are exhausted, got %d", rec.Code)
+	}
+	for _, s := range pool {
+		if got := atomic.LoadInt64(&s.activeConns); got != 0 {
+			t.Fatalf("expected %s's in-flight slot to be released, got activeConns=%d", s.URL, got)
+		}
+	}
+}
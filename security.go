@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSConfig configures TLS termination on the incoming listener.
+type TLSConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	CertFile     string   `yaml:"certFile"`
+	KeyFile      string   `yaml:"keyFile"`
+	ClientCAFile string   `yaml:"clientCAFile"`
+	MinVersion   string   `yaml:"minVersion"`
+	CipherSuites []string `yaml:"cipherSuites"`
+}
+
+var (
+	allowedNets      []*net.IPNet
+	trustedProxyNets []*net.IPNet
+)
+
+// initAllowlists precompiles incoming.allowedIPs and incoming.trustedProxies
+// into CIDR ranges so every request is checked with a simple containment
+// test instead of an exact string match.
+func initAllowlists(config *Config) {
+	allowedNets = parseCIDRList(config.Incoming.AllowedIPs, "incoming.allowedIPs")
+	trustedProxyNets = parseCIDRList(config.Incoming.TrustedProxies, "incoming.trustedProxies")
+}
+
+func parseCIDRList(entries []string, field string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		_, ipNet, err := net.ParseCIDR(asCIDR(entry))
+		if err != nil {
+			ErrorLog.Fatalf("Invalid entry %q in %s: %v", entry, field, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// asCIDR lets a plain IP address (no prefix) stand in for a single-host
+// range, so existing allowedIPs entries like "10.0.0.1" keep working.
+func asCIDR(entry string) string {
+	if strings.Contains(entry, "/") {
+		return entry
+	}
+	if strings.Contains(entry, ":") {
+		return entry + "/128"
+	}
+	return entry + "/32"
+}
+
+func isIPAllowed(ip string) bool {
+	if len(allowedNets) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range allowedNets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxyNets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the real client IP for r alongside the IP of the
+// direct TCP peer. X-Forwarded-For/X-Real-IP are only honored when the
+// direct peer is a trusted proxy; the XFF chain is walked right-to-left
+// (each proxy appends to the right) to find the first hop that isn't
+// itself a trusted proxy, since anything to the left of that is
+// attacker-controlled.
+func resolveClientIP(r *http.Request) (clientIP, directIP string) {
+	directIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if directIP == "" {
+		directIP = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(directIP) {
+		return directIP, directIP
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" || isTrustedProxy(hop) {
+				continue
+			}
+			return hop, directIP
+		}
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP, directIP
+	}
+
+	return directIP, directIP
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig translates incoming.tls into a *tls.Config. It returns a
+// nil config (and nil error) when TLS termination is disabled.
+func buildTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	minVersion := tls.VersionTLS12
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported incoming.tls.minVersion %q", cfg.MinVersion)
+		}
+		minVersion = int(v)
+	}
+
+	cipherSuites, err := resolveCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:   uint16(minVersion),
+		CipherSuites: cipherSuites,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading incoming.tls.clientCAFile: %w", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+func resolveCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	byName := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		byName[c.Name] = c.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q (see --list-ciphers)", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// listCiphers prints the TLS cipher suite names usable in
+// incoming.tls.cipherSuites, for the --list-ciphers flag.
+func listCiphers() {
+	for _, c := range tls.CipherSuites() {
+		fmt.Println(c.Name)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withTestAllowlists(t *testing.T, allowedIPs, trustedProxies []string) {
+	t.Helper()
+	prevAllowed, prevTrusted := allowedNets, trustedProxyNets
+
+	cfg := &Config{}
+	cfg.Incoming.AllowedIPs = allowedIPs
+	cfg.Incoming.TrustedProxies = trustedProxies
+	initAllowlists(cfg)
+
+	t.Cleanup(func() {
+		allowedNets, trustedProxyNets = prevAllowed, prevTrusted
+	})
+}
+
+func TestResolveClientIPUsesDirectPeerWhenUntrusted(t *testing.T) {
+	withTestAllowlists(t, nil, []string{"10.0.0.1"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	clientIP, directIP := resolveClientIP(req)
+	if clientIP != "203.0.113.9" {
+		t.Fatalf("expected XFF to be ignored from an untrusted direct peer, got clientIP=%q", clientIP)
+	}
+	if directIP != "203.0.113.9" {
+		t.Fatalf("expected directIP to be the RemoteAddr host, got %q", directIP)
+	}
+}
+
+func TestResolveClientIPWalksXFFRightToLeftPastTrustedProxies(t *testing.T) {
+	withTestAllowlists(t, nil, []string{"10.0.0.1", "10.0.0.2"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	// attacker, real client, then two trusted hops appended left-to-right.
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 198.51.100.1, 10.0.0.2, 10.0.0.1")
+
+	clientIP, directIP := resolveClientIP(req)
+	if clientIP != "198.51.100.1" {
+		t.Fatalf("expected the first non-trusted hop walking right-to-left, got %q", clientIP)
+	}
+	if directIP != "10.0.0.1" {
+		t.Fatalf("expected directIP to be the direct TCP peer, got %q", directIP)
+	}
+}
+
+func TestResolveClientIPFallsBackToXRealIPThenDirectPeer(t *testing.T) {
+	withTestAllowlists(t, nil, []string{"10.0.0.1"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Real-IP", "198.51.100.7")
+
+	clientIP, _ := resolveClientIP(req)
+	if clientIP != "198.51.100.7" {
+		t.Fatalf("expected X-Real-IP to be used when X-Forwarded-For is absent, got %q", clientIP)
+	}
+
+	req2 := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req2.RemoteAddr = "10.0.0.1:1234"
+	clientIP2, directIP2 := resolveClientIP(req2)
+	if clientIP2 != directIP2 || clientIP2 != "10.0.0.1" {
+		t.Fatalf("expected a trusted proxy with no forwarding headers to fall back to its own IP, got %q", clientIP2)
+	}
+}
+
+func TestResolveClientIPTreatsAllTrustedHopsAsNoRealClient(t *testing.T) {
+	withTestAllowlists(t, nil, []string{"10.0.0.1", "10.0.0.2"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://placeholder/path", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "10.0.0.2, 10.0.0.1")
+
+	clientIP, directIP := resolveClientIP(req)
+	if clientIP != directIP || clientIP != "10.0.0.1" {
+		t.Fatalf("expected an all-trusted XFF chain to fall back to the direct peer, got %q", clientIP)
+	}
+}
+
+func TestIsIPAllowedRespectsCIDRRanges(t *testing.T) {
+	withTestAllowlists(t, []string{"192.168.1.0/24", "203.0.113.5"}, nil)
+
+	if !isIPAllowed("192.168.1.42") {
+		t.Fatal("expected an address inside the CIDR range to be allowed")
+	}
+	if !isIPAllowed("203.0.113.5") {
+		t.Fatal("expected the bare-IP entry to be allowed as a /32")
+	}
+	if isIPAllowed("203.0.113.6") {
+		t.Fatal("expected a neighboring address not in any allowed range to be denied")
+	}
+}
+
+func TestIsIPAllowedAdmitsEverythingWhenUnconfigured(t *testing.T) {
+	withTestAllowlists(t, nil, nil)
+
+	if !isIPAllowed("1.2.3.4") {
+		t.Fatal("expected an empty allowedIPs list to admit every address")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats is the per-backend payload served by /stats.
+type serverStats struct {
+	URL          string `json:"url"`
+	Alive        bool   `json:"alive"`
+	Weight       int    `json:"weight"`
+	ActiveConns  int64  `json:"activeConns"`
+	BreakerState string `json:"breakerState"`
+	LastProbeAt  string `json:"lastProbeAt,omitempty"`
+}
+
+// statsHandler reports the current pool state, including each backend's
+// circuit-breaker state and last active-probe timestamp.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	pool := make([]*Server, len(serverPool))
+	copy(pool, serverPool)
+	mu.Unlock()
+
+	stats := make([]serverStats, 0, len(pool))
+	for _, s := range pool {
+		state, lastProbe := s.health.snapshot()
+		entry := serverStats{
+			URL:          s.URL,
+			Alive:        s.Alive.Load(),
+			Weight:       s.weight(),
+			ActiveConns:  atomic.LoadInt64(&s.activeConns),
+			BreakerState: state,
+		}
+		if !lastProbe.IsZero() {
+			entry.LastProbeAt = lastProbe.UTC().Format(time.RFC3339)
+		}
+		stats = append(stats, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}